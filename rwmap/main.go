@@ -3,28 +3,39 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/token"
 	"go/types"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/imports"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	out   = flag.String("o", "", "")
-	pkg   = flag.String("pkg", "main", "")
-	name  = flag.String("name", "Map", "")
-	ex    = flag.Bool("ex", false, "")
-	usage = `Usage: rwmap [options...] map[T1]T2
+	out        = flag.String("o", "", "")
+	pkg        = flag.String("pkg", "main", "")
+	name       = flag.String("name", "Map", "")
+	ex         = flag.Bool("ex", false, "")
+	generics   = flag.Bool("generics", false, "")
+	shards     = flag.Int("shards", 0, "")
+	persistent = flag.Bool("persistent", false, "")
+	configPath = flag.String("config", "", "")
+	checkFlag  = flag.Bool("check", false, "")
+	deepequal  = flag.Bool("deepequal", false, "")
+	usage      = `Usage: rwmap [options...] map[T1]T2
 
 Options:
   -o         Specify file output. If none is specified, the name
@@ -33,6 +44,34 @@ Options:
              specified, the name will main.
   -name      Struct name to use in the generated code. If none is
              specified, the name will be Map.
+  -generics  Emit a Go 1.18+ generic Map[K comparable, V any] instead
+             of mutating a map[interface{}]interface{} template. A
+             convenience alias (e.g. FooStringInt = Foo[string, int])
+             is added alongside the parameterized struct.
+  -shards N  Stripe the generated map's storage across N independently
+             locked shards instead of a single sync.RWMutex, routing
+             each key through an fnv64a hash of its string form.
+  -persistent Back the generated map with a persistent (copy-on-write)
+             treap instead of a plain map, so Snapshot() returns an
+             O(1) immutable, lock-free view for readers.
+             -generics, -shards and -persistent pick mutually exclusive
+             storage strategies; combining more than one is rejected.
+  -config    Path to a YAML or TOML file listing many maps to generate
+             in one invocation (see Config). Overrides the map[T1]T2
+             positional argument; -o/-pkg/-name/-ex/etc. are ignored
+             in favor of each entry's own fields.
+  -check     With -config, render every entry in memory and compare it
+             against its on-disk file instead of writing; exits
+             non-zero if any file is stale. Without -config, checks
+             just the single map[T1]T2 argument the same way.
+  -deepequal Compare values with reflect.DeepEqual instead of == in
+             CompareAndSwap/CompareAndDelete. Use this when the value
+             type may hold uncomparable data (e.g. a slice or map): with
+             == such a value type fails the type check, and an
+             interface{} value holding one panics at runtime. Ignored
+             under -generics, whose
+             CompareAndSwap/CompareAndDelete always use reflect.DeepEqual
+             since the V any type parameter isn't guaranteed comparable.
 `
 )
 var templateCode = `
@@ -219,6 +258,41 @@ func (m *Map) ItemMap() (tmp map[interface{}]interface{}) {
 	return
 }
 
+// Len returns the number of entries currently stored in the map.
+func (m *Map) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data)
+}
+
+// RangeKeys calls f sequentially for each key present in the map, stopping
+// early if f returns false. See Range for the consistency guarantees.
+func (m *Map) RangeKeys(f func(key interface{}) bool) {
+	m.Range(func(key, _ interface{}) bool {
+		return f(key)
+	})
+}
+
+// RangeValues calls f sequentially for each value present in the map,
+// stopping early if f returns false. See Range for the consistency
+// guarantees.
+func (m *Map) RangeValues(f func(value interface{}) bool) {
+	m.Range(func(_, value interface{}) bool {
+		return f(value)
+	})
+}
+
+// Swap stores value for key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map) Swap(key, value interface{}) (previous interface{}, loaded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	previous, loaded = m.data[key]
+	m.data[key] = value
+	return
+}
+
 func (m *Map) FromDB(data []byte) (err error) {
 	if len(data) == 0 {
 		m.Init()
@@ -275,6 +349,70 @@ func (m *Map) String() string {
 }
 `
 
+var templateCodeCompareEqual = `
+
+// CompareAndSwap stores new for key if the existing value equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || cur != old {
+		return false
+	}
+	m.data[key] = new
+	return true
+}
+
+// CompareAndDelete deletes the entry for key if its value equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || cur != old {
+		return false
+	}
+	delete(m.data, key)
+	return true
+}
+
+`
+
+var templateCodeCompareDeepEqual = `
+
+// CompareAndSwap stores new for key if the existing value deep-equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	m.data[key] = new
+	return true
+}
+
+// CompareAndDelete deletes the entry for key if its value deep-equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	delete(m.data, key)
+	return true
+}
+
+`
+
 var templateCodeExTrue = `
 
 // AddStore add the value for a key.
@@ -317,164 +455,2070 @@ func (m *Map) AddStores(key, value []interface{}) {
 
 `
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(usage))
+var templateCodeGenerics = `
+package rwmap
+
+import (
+	"errors"
+	"github.com/json-iterator/go"
+	"reflect"
+	"sync"
+)
+
+// Map is like a sync.Map, Reduce GC scanning
+type Map[K comparable, V any] struct {
+	data map[K]V
+	mu   sync.RWMutex
+}
+
+func (m *Map[K, V]) checkData() {
+	if m.data == nil {
+		m.data = map[K]V{}
 	}
-	flag.Parse()
-	g, err := NewGenerator()
-	failOnErr(err)
-	err = g.Mutate()
-	failOnErr(err)
-	err = g.Gen()
-	failOnErr(err)
 }
 
-// Generator generates the typed rwmap object.
-type Generator struct {
-	// flag options.
-	pkg   string // package name.
-	out   string // file name.
-	name  string // struct name.
-	key   string // map key type.
-	value string // map value type.
-	// mutation state and traversal handlers.
-	file   *ast.File
-	fset   *token.FileSet
-	funcs  map[string]func(*ast.FuncDecl)
-	types  map[string]func(*ast.TypeSpec)
-	values map[string]func(*ast.ValueSpec)
+func (m *Map[K, V]) Init() *Map[K, V] {
+	m.mu.Lock()
+	m.data = map[K]V{}
+	m.mu.Unlock()
+	return m
 }
 
-// NewGenerator returns a new generator for rwmap.
-func NewGenerator() (g *Generator, err error) {
-	defer catch(&err)
-	g = &Generator{fset: token.NewFileSet(), pkg: *pkg, out: *out, name: *name}
-	g.funcs = g.Funcs()
-	g.types = g.Types()
-	g.values = g.Values()
-	exp, err := parser.ParseExpr(os.Args[len(os.Args)-1])
-	check(err, "parse expr: %s", os.Args[len(os.Args)-1])
-	m, ok := exp.(*ast.MapType)
-	expect(ok, "invalid argument. expected map[T1]T2")
-	b := bytes.NewBuffer(nil)
-	err = format.Node(b, g.fset, m.Key)
-	check(err, "format map key")
-	g.key = b.String()
-	b.Reset()
-	err = format.Node(b, g.fset, m.Value)
-	check(err, "format map value")
-	g.value = b.String()
-	if g.out == "" {
-		g.out = "001_" + strings.ToLower(g.name) + ".go"
+func (m *Map[K, V]) Change(newMap map[K]V) {
+	m.mu.Lock()
+	m.data = newMap
+	m.mu.Unlock()
+}
+
+// Load returns the value stored in the map for a key, or the zero value if no
+// value is present.
+// The ok result indicates whether value was found in the map.
+func (m *Map[K, V]) Load(key K) (value V, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok = m.data[key]
+	return
+}
+
+// Store sets the value for a key.
+func (m *Map[K, V]) Store(key K, value V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	m.data[key] = value
+	return
+}
+
+// Stores sets the value for a key.
+func (m *Map[K, V]) Stores(keys []K, values []V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	for idx, key := range keys {
+		m.data[key] = values[idx]
 	}
 	return
 }
 
-// Mutate mutates the original `sync/map` AST and brings it to the desired state.
-// It fails if it encounters an unrecognized node in the AST.
-func (g *Generator) Mutate() (err error) {
-	defer catch(&err)
-	//path := fmt.Sprintf("./rwmap/rwmap/rwmap.go")
-	//b, err := ioutil.ReadFile(path)
-	//check(err, "read %q file", path)
-	if *ex {
-		templateCode = templateCode + templateCodeExTrue
-	} else {
-		templateCode = templateCode + templateCodeExFalse
+// StoreMap sets the value for a key.
+func (m *Map[K, V]) StoreMap(tmp map[K]V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	for key, value := range tmp {
+		m.data[key] = value
 	}
-	f, err := parser.ParseFile(g.fset, "", templateCode, parser.ParseComments)
-	//check(err, "parse %q file", path)
-	f.Name.Name = g.pkg
-	astutil.AddImport(g.fset, f, "sync")
-	for _, d := range f.Decls {
-		switch d := d.(type) {
-		case *ast.FuncDecl:
-			handler, ok := g.funcs[d.Name.Name]
-			expect(ok, "unrecognized function: %s", d.Name.Name)
-			handler(d)
-			delete(g.funcs, d.Name.Name)
-		case *ast.GenDecl:
-			switch d := d.Specs[0].(type) {
-			case *ast.TypeSpec:
-				handler, ok := g.types[d.Name.Name]
-				expect(ok, "unrecognized type: %s", d.Name.Name)
-				handler(d)
-				delete(g.types, d.Name.Name)
-			case *ast.ValueSpec:
-				handler, ok := g.values[d.Names[0].Name]
-				expect(ok, "unrecognized value: %s", d.Names[0].Name)
-				handler(d)
-				expect(len(d.Names) == 1, "mismatch values length: %d", len(d.Names))
-				delete(g.values, d.Names[0].Name)
-			}
-		default:
-			expect(false, "unrecognized type: %s", d)
+	return
+}
+
+// LoadOrStore returns the existing value for the key if present.
+// Otherwise, it stores and returns the given value.
+// The loaded result is true if the value was loaded, false if stored.
+func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	m.mu.RLock()
+	if m.data == nil {
+		m.mu.RUnlock()
+		m.mu.Lock()
+		m.checkData()
+		m.mu.Unlock()
+		m.mu.RLock()
+	}
+	actual, loaded = m.data[key]
+	m.mu.RUnlock()
+	if !loaded {
+		m.mu.Lock()
+		if actual, loaded = m.data[key]; !loaded {
+			m.data[key] = value
+			actual = value
 		}
+		m.mu.Unlock()
 	}
-	expect(len(g.funcs) == 0, "function was deleted")
-	expect(len(g.types) == 0, "type was deleted")
-	expect(len(g.values) == 0, "value was deleted")
-	rename(f, map[string]string{
-		"Map":      g.name,
-		"entry":    "entry" + strings.Title(g.name),
-		"readOnly": "readOnly" + strings.Title(g.name),
-		"expunged": "expunged" + strings.Title(g.name),
-		"newEntry": "newEntry" + strings.Title(g.name),
-	})
-	g.file = f
 	return
 }
 
-// Gen dumps the mutated AST to a file in the configured destination.
-func (g *Generator) Gen() (err error) {
-	defer catch(&err)
-	b := bytes.NewBuffer([]byte("// Code generated by rwmap; DO NOT EDIT.\n\n"))
-	err = format.Node(b, g.fset, g.file)
-	check(err, "format mutated code")
-	src, err := imports.Process(g.out, b.Bytes(), nil)
-	check(err, "running goimports on: %s", g.out)
-	err = ioutil.WriteFile(g.out, src, 0644)
-	check(err, "writing file: %s", g.out)
+// LoadAndDelete deletes the value for a key, returning the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	value, loaded = m.data[key]
+	if loaded {
+		delete(m.data, key)
+	}
 	return
 }
 
-// Values returns all ValueSpec handlers for AST mutation.
-func (g *Generator) Values() map[string]func(*ast.ValueSpec) {
-	return map[string]func(*ast.ValueSpec){}
+// Delete deletes the value for a key.
+func (m *Map[K, V]) Delete(key K) {
+	m.LoadAndDelete(key)
 }
 
-// Types returns all TypesSpec handlers for AST mutation.
-func (g *Generator) Types() map[string]func(*ast.TypeSpec) {
-	return map[string]func(*ast.TypeSpec){
-		"Map": func(t *ast.TypeSpec) {
-			l := t.Type.(*ast.StructType).Fields.List[0]
-			g.renameMapType(l)
-		},
+// Delete deletes the all value.
+func (m *Map[K, V]) DeleteAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	length := len(m.data)
+	keys := make([]K, length)
+	idx := 0
+	for key, _ := range m.data {
+		keys[idx] = key
+		idx++
+	}
+	for _, key := range keys {
+		delete(m.data, key)
 	}
 }
 
-// Funcs returns all FuncDecl handlers for AST mutation.
-func (g *Generator) Funcs() map[string]func(*ast.FuncDecl) {
-	//nop := func(*ast.FuncDecl) {}
-	return map[string]func(*ast.FuncDecl){
-		"Init": func(f *ast.FuncDecl) {
-			g.renameMapType(f.Body)
-		},
-		"checkData": func(f *ast.FuncDecl) {
-			g.renameMapType(f.Body)
-		},
-		"Change": func(f *ast.FuncDecl) {
-			g.renameMapType(f.Type.Params)
-		},
-		"Load": func(f *ast.FuncDecl) {
-			g.replaceKey(f.Type.Params)
-			g.replaceValue(f.Type.Results)
-			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
-		},
-		"Store": func(f *ast.FuncDecl) {
-			g.renameTuple(f.Type.Params)
-		},
+// Range calls f sequentially for each key and value present in the map.
+// If f returns false, range stops the iteration.
+//
+// Range does not necessarily correspond to any consistent snapshot of the Map's
+// contents: no key will be visited more than once, but if the value for any key
+// is stored or deleted concurrently, Range may reflect any mapping for that key
+// from any point during the Range call.
+//
+// Range may be O(N) with the number of elements in the map even if f returns
+// false after a constant number of calls.
+func (m *Map[K, V]) Range(f func(key K, value V) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for key, value := range m.data {
+		if !f(key, value) {
+			break
+		}
+	}
+	return
+}
+
+// Items return keys and values present in the map.
+func (m *Map[K, V]) Items() (keys []K, values []V) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	length := len(m.data)
+	keys = make([]K, length)
+	values = make([]V, length)
+	idx := 0
+	for key, value := range m.data {
+		keys[idx] = key
+		values[idx] = value
+		idx++
+	}
+	return
+}
+
+// ItemMap return keys and values present in the map.
+func (m *Map[K, V]) ItemMap() (tmp map[K]V) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	length := len(m.data)
+	tmp = make(map[K]V, length)
+	for key, value := range m.data {
+		tmp[key] = value
+	}
+	return
+}
+
+// Len returns the number of entries currently stored in the map.
+func (m *Map[K, V]) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data)
+}
+
+// RangeKeys calls f sequentially for each key present in the map, stopping
+// early if f returns false. See Range for the consistency guarantees.
+func (m *Map[K, V]) RangeKeys(f func(key K) bool) {
+	m.Range(func(key K, _ V) bool {
+		return f(key)
+	})
+}
+
+// RangeValues calls f sequentially for each value present in the map,
+// stopping early if f returns false. See Range for the consistency
+// guarantees.
+func (m *Map[K, V]) RangeValues(f func(value V) bool) {
+	m.Range(func(_ K, value V) bool {
+		return f(value)
+	})
+}
+
+// Swap stores value for key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	previous, loaded = m.data[key]
+	m.data[key] = value
+	return
+}
+
+// CompareAndSwap stores new for key if the existing value deep-equals old.
+// The swapped result reports whether the swap happened. It uses
+// reflect.DeepEqual rather than == since V any isn't guaranteed comparable.
+func (m *Map[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	m.data[key] = new
+	return true
+}
+
+// CompareAndDelete deletes the entry for key if its value deep-equals old.
+// The deleted result reports whether the delete happened. It uses
+// reflect.DeepEqual rather than == since V any isn't guaranteed comparable.
+func (m *Map[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkData()
+	cur, ok := m.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	delete(m.data, key)
+	return true
+}
+
+func (m *Map[K, V]) FromDB(data []byte) (err error) {
+	if len(data) == 0 {
+		m.Init()
+		return nil
+	}
+	err = m.UnmarshalJSON(data)
+	return
+}
+
+func (m *Map[K, V]) ToDB() (data []byte, err error) {
+	data, err = m.MarshalJSON()
+	return
+}
+
+func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ret, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(m.data)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+
+}
+
+func (m *Map[K, V]) UnmarshalJSON(b []byte) error {
+	if m == nil {
+		return errors.New(" Unmarshal(non-pointer MapInt32Int8)")
+	}
+	tmp := map[K]V{}
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+	if tmp == nil {
+		tmp = map[K]V{}
+	}
+	m.Change(tmp)
+	return nil
+}
+
+func (m *Map[K, V]) String() string {
+	if m == nil {
+		return "{}"
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+`
+
+var templateCodeGenericsExTrue = `
+
+// AddStore add the value for a key.
+func (m *Map[K, V]) AddStore(key K, value V) (ret V) {
+	m.mu.Lock()
+	m.checkData()
+	ret = m.data[key]
+    ret += value
+	m.data[key] = ret
+	m.mu.Unlock()
+	return
+}
+
+// AddStores add the values for a keys.
+func (m *Map[K, V]) AddStores(keys []K, values []V) {
+	m.mu.Lock()
+	m.checkData()
+	for i, key := range keys {
+		m.data[key] += values[i]
+	}
+	m.mu.Unlock()
+	return
+}
+
+`
+
+var templateCodeGenericsExFalse = `
+
+// AddStore add the value for a key.
+func (m *Map[K, V]) AddStore(key K, value V) (ret V) {
+	panic("Not Implemented")
+}
+
+// AddStores add the values for a keys.
+func (m *Map[K, V]) AddStores(keys []K, values []V) {
+	panic("Not Implemented")
+}
+
+`
+
+var templateCodeShard = `
+package rwmap
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"github.com/json-iterator/go"
+	"sync"
+)
+
+const shardCount = 32
+
+type shard struct {
+	mu   sync.RWMutex
+	data map[interface{}]interface{}
+}
+
+func (s *shard) checkData() {
+	if s.data == nil {
+		s.data = map[interface{}]interface{}{}
+	}
+}
+
+// Map is like a sync.Map, but stripes its storage across shardCount
+// independently locked shards so a single RWMutex never becomes a
+// bottleneck under mixed read/write workloads.
+type Map struct {
+	shards [shardCount]shard
+}
+
+// shardIndex routes a key to one of shardCount shards via an fnv64a hash of
+// its string form.
+func shardIndex(key interface{}) int {
+	h := fnv.New64a()
+	fmt.Fprint(h, key)
+	return int(h.Sum64() % shardCount)
+}
+
+func (m *Map) shardFor(key interface{}) *shard {
+	return &m.shards[shardIndex(key)]
+}
+
+func (m *Map) Init() *Map {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+		m.shards[i].data = map[interface{}]interface{}{}
+		m.shards[i].mu.Unlock()
+	}
+	return m
+}
+
+func (m *Map) Change(newMap map[interface{}]interface{}) {
+	m.Init()
+	for key, value := range newMap {
+		m.Store(key, value)
+	}
+}
+
+// Load returns the value stored in the map for a key, or nil if no
+// value is present.
+// The ok result indicates whether value was found in the map.
+func (m *Map) Load(key interface{}) (value interface{}, ok bool) {
+	s := m.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok = s.data[key]
+	return
+}
+
+// Store sets the value for a key.
+func (m *Map) Store(key, value interface{}) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	s.data[key] = value
+	return
+}
+
+// Stores sets the value for a key.
+func (m *Map) Stores(keys, values []interface{}) {
+	for idx, key := range keys {
+		m.Store(key, values[idx])
+	}
+	return
+}
+
+// StoreMap sets the value for a key.
+func (m *Map) StoreMap(tmp map[interface{}]interface{}) {
+	for key, value := range tmp {
+		m.Store(key, value)
+	}
+	return
+}
+
+// LoadOrStore returns the existing value for the key if present.
+// Otherwise, it stores and returns the given value.
+// The loaded result is true if the value was loaded, false if stored.
+func (m *Map) LoadOrStore(key, value interface{}) (actual interface{}, loaded bool) {
+	s := m.shardFor(key)
+	s.mu.RLock()
+	actual, loaded = s.data[key]
+	s.mu.RUnlock()
+	if !loaded {
+		s.mu.Lock()
+		s.checkData()
+		if actual, loaded = s.data[key]; !loaded {
+			s.data[key] = value
+			actual = value
+		}
+		s.mu.Unlock()
+	}
+	return
+}
+
+// LoadAndDelete deletes the value for a key, returning the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map) LoadAndDelete(key interface{}) (value interface{}, loaded bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	value, loaded = s.data[key]
+	if loaded {
+		delete(s.data, key)
+	}
+	return
+}
+
+// Delete deletes the value for a key.
+func (m *Map) Delete(key interface{}) {
+	m.LoadAndDelete(key)
+}
+
+// Delete deletes the all value.
+func (m *Map) DeleteAll() {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		s.data = map[interface{}]interface{}{}
+		s.mu.Unlock()
+	}
+}
+
+// Range calls f sequentially for each key and value present in the map.
+// If f returns false, range stops the iteration.
+//
+// Range locks shards in ascending order, one at a time, so it can never
+// deadlock against another Range call and always sees a consistent-enough
+// snapshot of each shard it visits.
+func (m *Map) Range(f func(key, value interface{}) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		for key, value := range s.data {
+			if !f(key, value) {
+				s.mu.RUnlock()
+				return
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// Items return keys and values present in the map.
+func (m *Map) Items() (keys, values []interface{}) {
+	m.Range(func(key, value interface{}) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	return
+}
+
+// ItemMap return keys and values present in the map.
+func (m *Map) ItemMap() (tmp map[interface{}]interface{}) {
+	tmp = map[interface{}]interface{}{}
+	m.Range(func(key, value interface{}) bool {
+		tmp[key] = value
+		return true
+	})
+	return
+}
+
+// Len returns the number of entries currently stored in the map.
+func (m *Map) Len() (n int) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		n += len(s.data)
+		s.mu.RUnlock()
+	}
+	return
+}
+
+// RangeKeys calls f sequentially for each key present in the map, stopping
+// early if f returns false. See Range for the consistency guarantees.
+func (m *Map) RangeKeys(f func(key interface{}) bool) {
+	m.Range(func(key, _ interface{}) bool {
+		return f(key)
+	})
+}
+
+// RangeValues calls f sequentially for each value present in the map,
+// stopping early if f returns false. See Range for the consistency
+// guarantees.
+func (m *Map) RangeValues(f func(value interface{}) bool) {
+	m.Range(func(_, value interface{}) bool {
+		return f(value)
+	})
+}
+
+// Swap stores value for key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map) Swap(key, value interface{}) (previous interface{}, loaded bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	previous, loaded = s.data[key]
+	s.data[key] = value
+	return
+}
+
+func (m *Map) FromDB(data []byte) (err error) {
+	if len(data) == 0 {
+		m.Init()
+		return nil
+	}
+	err = m.UnmarshalJSON(data)
+	return
+}
+
+func (m *Map) ToDB() (data []byte, err error) {
+	data, err = m.MarshalJSON()
+	return
+}
+
+func (m *Map) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	ret, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(m.ItemMap())
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+
+}
+
+func (m *Map) UnmarshalJSON(b []byte) error {
+	if m == nil {
+		return errors.New(" Unmarshal(non-pointer MapInt32Int8)")
+	}
+	tmp := map[interface{}]interface{}{}
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+	if tmp == nil {
+		tmp = map[interface{}]interface{}{}
+	}
+	m.Change(tmp)
+	return nil
+}
+
+func (m *Map) String() string {
+	if m == nil {
+		return "{}"
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+`
+
+var templateCodeShardCompareEqual = `
+
+// CompareAndSwap stores new for key if the existing value equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	cur, ok := s.data[key]
+	if !ok || cur != old {
+		return false
+	}
+	s.data[key] = new
+	return true
+}
+
+// CompareAndDelete deletes the entry for key if its value equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	cur, ok := s.data[key]
+	if !ok || cur != old {
+		return false
+	}
+	delete(s.data, key)
+	return true
+}
+
+`
+
+var templateCodeShardCompareDeepEqual = `
+
+// CompareAndSwap stores new for key if the existing value deep-equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	cur, ok := s.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	s.data[key] = new
+	return true
+}
+
+// CompareAndDelete deletes the entry for key if its value deep-equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkData()
+	cur, ok := s.data[key]
+	if !ok || !reflect.DeepEqual(cur, old) {
+		return false
+	}
+	delete(s.data, key)
+	return true
+}
+
+`
+
+var templateCodeShardExTrue = `
+
+// AddStore add the value for a key.
+func (m *Map) AddStore(key, value interface{}) (ret interface{}) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	s.checkData()
+	ret = s.data[key]
+	ret += value
+	s.data[key] = ret
+	s.mu.Unlock()
+	return
+}
+
+// AddStores add the values for a keys.
+func (m *Map) AddStores(keys, values []interface{}) {
+	for i, key := range keys {
+		m.AddStore(key, values[i])
+	}
+	return
+}
+
+`
+
+var templateCodeShardExFalse = `
+
+// AddStore add the value for a key.
+func (m *Map) AddStore(key, value interface{}) {
+	panic("Not Implemented")
+	return
+}
+
+// AddStores add the values for a keys.
+func (m *Map) AddStores(key, value []interface{}) {
+	panic("Not Implemented")
+	return
+}
+
+`
+
+var templateCodePersistent = `
+package rwmap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/json-iterator/go"
+	"math/rand"
+	"sync/atomic"
+)
+
+// node is a persistent treap node: every mutation allocates new nodes along
+// the path to the root rather than mutating in place, so any root a reader
+// holds stays coherent forever.
+type node struct {
+	key      interface{}
+	value    interface{}
+	priority uint32
+	left     *node
+	right    *node
+}
+
+// Map is a persistent (copy-on-write) treap. Store/Delete/LoadOrStore build a
+// new root and CAS-swap it into place, so Snapshot and Range never block
+// writers and never observe a partially applied mutation.
+type Map struct {
+	root atomic.Pointer[node]
+	// Less reports whether a sorts before b. It defaults to comparing the
+	// %v formatting of the two keys when nil.
+	Less func(a, b interface{}) bool
+}
+
+func (m *Map) less() func(a, b interface{}) bool {
+	if m.Less != nil {
+		return m.Less
+	}
+	return func(a, b interface{}) bool {
+		return fmt.Sprint(a) < fmt.Sprint(b)
+	}
+}
+
+func treapInsert(less func(a, b interface{}) bool, n *node, key, value interface{}) *node {
+	if n == nil {
+		return &node{key: key, value: value, priority: rand.Uint32()}
+	}
+	switch {
+	case key == n.key:
+		return &node{key: key, value: value, priority: n.priority, left: n.left, right: n.right}
+	case less(key, n.key):
+		left := treapInsert(less, n.left, key, value)
+		out := &node{key: n.key, value: n.value, priority: n.priority, left: left, right: n.right}
+		if left.priority > out.priority {
+			out = treapRotateRight(out)
+		}
+		return out
+	default:
+		right := treapInsert(less, n.right, key, value)
+		out := &node{key: n.key, value: n.value, priority: n.priority, left: n.left, right: right}
+		if right.priority > out.priority {
+			out = treapRotateLeft(out)
+		}
+		return out
+	}
+}
+
+func treapRotateRight(n *node) *node {
+	l := n.left
+	n = &node{key: n.key, value: n.value, priority: n.priority, left: l.right, right: n.right}
+	return &node{key: l.key, value: l.value, priority: l.priority, left: l.left, right: n}
+}
+
+func treapRotateLeft(n *node) *node {
+	r := n.right
+	n = &node{key: n.key, value: n.value, priority: n.priority, left: n.left, right: r.left}
+	return &node{key: r.key, value: r.value, priority: r.priority, left: n, right: r.right}
+}
+
+// treapDelete rotates the target node down toward its higher-priority child
+// until it becomes a leaf, then drops it.
+func treapDelete(less func(a, b interface{}) bool, n *node, key interface{}) *node {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case key == n.key:
+		if n.left == nil {
+			return n.right
+		}
+		if n.right == nil {
+			return n.left
+		}
+		if n.left.priority > n.right.priority {
+			out := treapRotateRight(n)
+			out.right = treapDelete(less, out.right, key)
+			return out
+		}
+		out := treapRotateLeft(n)
+		out.left = treapDelete(less, out.left, key)
+		return out
+	case less(key, n.key):
+		return &node{key: n.key, value: n.value, priority: n.priority, left: treapDelete(less, n.left, key), right: n.right}
+	default:
+		return &node{key: n.key, value: n.value, priority: n.priority, left: n.left, right: treapDelete(less, n.right, key)}
+	}
+}
+
+func treapLoad(less func(a, b interface{}) bool, n *node, key interface{}) (value interface{}, ok bool) {
+	for n != nil {
+		switch {
+		case key == n.key:
+			return n.value, true
+		case less(key, n.key):
+			n = n.left
+		default:
+			n = n.right
+		}
+	}
+	return nil, false
+}
+
+func treapRange(n *node, f func(key, value interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	if !treapRange(n.left, f) {
+		return false
+	}
+	if !f(n.key, n.value) {
+		return false
+	}
+	return treapRange(n.right, f)
+}
+
+func (m *Map) Init() *Map {
+	m.root.Store(nil)
+	return m
+}
+
+func (m *Map) Change(newMap map[interface{}]interface{}) {
+	less := m.less()
+	var root *node
+	for key, value := range newMap {
+		root = treapInsert(less, root, key, value)
+	}
+	m.root.Store(root)
+}
+
+// Load returns the value stored in the map for a key, or nil if no
+// value is present.
+// The ok result indicates whether value was found in the map.
+func (m *Map) Load(key interface{}) (value interface{}, ok bool) {
+	return treapLoad(m.less(), m.root.Load(), key)
+}
+
+// Store sets the value for a key.
+func (m *Map) Store(key, value interface{}) {
+	less := m.less()
+	for {
+		old := m.root.Load()
+		next := treapInsert(less, old, key, value)
+		if m.root.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// Stores sets the value for a key.
+func (m *Map) Stores(keys, values []interface{}) {
+	for idx, key := range keys {
+		m.Store(key, values[idx])
+	}
+	return
+}
+
+// StoreMap sets the value for a key.
+func (m *Map) StoreMap(tmp map[interface{}]interface{}) {
+	for key, value := range tmp {
+		m.Store(key, value)
+	}
+	return
+}
+
+// LoadOrStore returns the existing value for the key if present.
+// Otherwise, it stores and returns the given value.
+// The loaded result is true if the value was loaded, false if stored.
+func (m *Map) LoadOrStore(key, value interface{}) (actual interface{}, loaded bool) {
+	less := m.less()
+	for {
+		old := m.root.Load()
+		if v, ok := treapLoad(less, old, key); ok {
+			return v, true
+		}
+		next := treapInsert(less, old, key, value)
+		if m.root.CompareAndSwap(old, next) {
+			return value, false
+		}
+	}
+}
+
+// LoadAndDelete deletes the value for a key, returning the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map) LoadAndDelete(key interface{}) (value interface{}, loaded bool) {
+	less := m.less()
+	for {
+		old := m.root.Load()
+		v, ok := treapLoad(less, old, key)
+		if !ok {
+			return nil, false
+		}
+		next := treapDelete(less, old, key)
+		if m.root.CompareAndSwap(old, next) {
+			return v, true
+		}
+	}
+}
+
+// Delete deletes the value for a key.
+func (m *Map) Delete(key interface{}) {
+	m.LoadAndDelete(key)
+}
+
+// Delete deletes the all value.
+func (m *Map) DeleteAll() {
+	m.root.Store(nil)
+}
+
+// Range calls f sequentially for each key and value present in the map, in
+// key order. Range reads an immutable root snapshot, so it needs no locking
+// and never blocks or is blocked by concurrent writers.
+func (m *Map) Range(f func(key, value interface{}) bool) {
+	treapRange(m.root.Load(), f)
+}
+
+// Snapshot returns an O(1) immutable view of the map. Concurrent writers on m
+// cannot mutate it, and Range over the snapshot is lock-free.
+func (m *Map) Snapshot() *Map {
+	snap := &Map{Less: m.Less}
+	snap.root.Store(m.root.Load())
+	return snap
+}
+
+// Items return keys and values present in the map.
+func (m *Map) Items() (keys, values []interface{}) {
+	m.Range(func(key, value interface{}) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	return
+}
+
+// ItemMap return keys and values present in the map.
+func (m *Map) ItemMap() (tmp map[interface{}]interface{}) {
+	tmp = map[interface{}]interface{}{}
+	m.Range(func(key, value interface{}) bool {
+		tmp[key] = value
+		return true
+	})
+	return
+}
+
+// Len returns the number of entries currently stored in the map.
+func (m *Map) Len() (n int) {
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// RangeKeys calls f sequentially for each key present in the map, in key
+// order, stopping early if f returns false.
+func (m *Map) RangeKeys(f func(key interface{}) bool) {
+	m.Range(func(key, _ interface{}) bool {
+		return f(key)
+	})
+}
+
+// RangeValues calls f sequentially for each value present in the map, in
+// key order, stopping early if f returns false.
+func (m *Map) RangeValues(f func(value interface{}) bool) {
+	m.Range(func(_, value interface{}) bool {
+		return f(value)
+	})
+}
+
+// Swap stores value for key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map) Swap(key, value interface{}) (previous interface{}, loaded bool) {
+	less := m.less()
+	for {
+		old := m.root.Load()
+		previous, loaded = treapLoad(less, old, key)
+		next := treapInsert(less, old, key, value)
+		if m.root.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+func (m *Map) FromDB(data []byte) (err error) {
+	if len(data) == 0 {
+		m.Init()
+		return nil
+	}
+	err = m.UnmarshalJSON(data)
+	return
+}
+
+func (m *Map) ToDB() (data []byte, err error) {
+	data, err = m.MarshalJSON()
+	return
+}
+
+func (m *Map) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	ret, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(m.ItemMap())
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+
+}
+
+func (m *Map) UnmarshalJSON(b []byte) error {
+	if m == nil {
+		return errors.New(" Unmarshal(non-pointer MapInt32Int8)")
+	}
+	tmp := map[interface{}]interface{}{}
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+	if tmp == nil {
+		tmp = map[interface{}]interface{}{}
+	}
+	m.Change(tmp)
+	return nil
+}
+
+func (m *Map) String() string {
+	if m == nil {
+		return "{}"
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+`
+
+var templateCodePersistentCompareEqual = `
+
+// CompareAndSwap stores new for key if the existing value equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	less := m.less()
+	for {
+		root := m.root.Load()
+		cur, ok := treapLoad(less, root, key)
+		if !ok || cur != old {
+			return false
+		}
+		next := treapInsert(less, root, key, new)
+		if m.root.CompareAndSwap(root, next) {
+			return true
+		}
+	}
+}
+
+// CompareAndDelete deletes the entry for key if its value equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	less := m.less()
+	for {
+		root := m.root.Load()
+		cur, ok := treapLoad(less, root, key)
+		if !ok || cur != old {
+			return false
+		}
+		next := treapDelete(less, root, key)
+		if m.root.CompareAndSwap(root, next) {
+			return true
+		}
+	}
+}
+
+`
+
+var templateCodePersistentCompareDeepEqual = `
+
+// CompareAndSwap stores new for key if the existing value deep-equals old.
+// The swapped result reports whether the swap happened.
+func (m *Map) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	less := m.less()
+	for {
+		root := m.root.Load()
+		cur, ok := treapLoad(less, root, key)
+		if !ok || !reflect.DeepEqual(cur, old) {
+			return false
+		}
+		next := treapInsert(less, root, key, new)
+		if m.root.CompareAndSwap(root, next) {
+			return true
+		}
+	}
+}
+
+// CompareAndDelete deletes the entry for key if its value deep-equals old.
+// The deleted result reports whether the delete happened.
+func (m *Map) CompareAndDelete(key, old interface{}) (deleted bool) {
+	less := m.less()
+	for {
+		root := m.root.Load()
+		cur, ok := treapLoad(less, root, key)
+		if !ok || !reflect.DeepEqual(cur, old) {
+			return false
+		}
+		next := treapDelete(less, root, key)
+		if m.root.CompareAndSwap(root, next) {
+			return true
+		}
+	}
+}
+
+`
+
+var templateCodePersistentExTrue = `
+
+// AddStore add the value for a key.
+func (m *Map) AddStore(key, value interface{}) (ret interface{}) {
+	less := m.less()
+	for {
+		old := m.root.Load()
+		cur, ok := treapLoad(less, old, key)
+		if !ok {
+			ret = value
+		} else {
+			ret = cur
+			ret += value
+		}
+		next := treapInsert(less, old, key, ret)
+		if m.root.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// AddStores add the values for a keys.
+func (m *Map) AddStores(keys, values []interface{}) {
+	for i, key := range keys {
+		m.AddStore(key, values[i])
+	}
+	return
+}
+
+`
+
+var templateCodePersistentExFalse = `
+
+// AddStore add the value for a key.
+func (m *Map) AddStore(key, value interface{}) {
+	panic("Not Implemented")
+	return
+}
+
+// AddStores add the values for a keys.
+func (m *Map) AddStores(key, value []interface{}) {
+	panic("Not Implemented")
+	return
+}
+
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, fmt.Sprintf(usage))
+	}
+	flag.Parse()
+	if *configPath != "" {
+		failOnErr(runConfig())
+		return
+	}
+	g, err := NewGenerator()
+	failOnErr(err)
+	err = g.Mutate()
+	failOnErr(err)
+	if *checkFlag {
+		stale, err := g.Stale()
+		failOnErr(err)
+		if stale {
+			fmt.Fprintf(os.Stderr, "%s is stale; run rwmap to regenerate\n", g.out)
+			os.Exit(1)
+		}
+		return
+	}
+	err = g.Gen()
+	failOnErr(err)
+}
+
+// runConfig drives batch generation for -config: every entry gets its own
+// Generator from one shared generatorFactory, so a given template variant
+// is parsed once per runConfig call no matter how many entries request it,
+// and each entry mutates its own deep copy of that AST.
+func runConfig() (err error) {
+	defer catch(&err)
+	cfg, err := loadConfig(*configPath)
+	check(err, "load config: %s", *configPath)
+	gf := newGeneratorFactory()
+	var stale []string
+	for _, e := range cfg.Maps {
+		g, err := gf.New(e)
+		check(err, "config entry %q", e.Name)
+		check(g.Mutate(), "config entry %q", e.Name)
+		if *checkFlag {
+			isStale, err := g.Stale()
+			check(err, "config entry %q", e.Name)
+			if isStale {
+				stale = append(stale, g.out)
+			}
+			continue
+		}
+		check(g.Gen(), "config entry %q", e.Name)
+	}
+	expect(!*checkFlag || len(stale) == 0, "%d file(s) need regeneration: %s", len(stale), strings.Join(stale, ", "))
+	return
+}
+
+// Config is the top-level document read by -config: a list of maps to
+// generate in one invocation, turning rwmap from a per-file go:generate
+// directive into a project-wide code-gen driver.
+type Config struct {
+	Maps []ConfigEntry `yaml:"maps" toml:"maps"`
+}
+
+// ConfigEntry mirrors the CLI flags for a single generated map.
+type ConfigEntry struct {
+	Name       string `yaml:"name" toml:"name"`
+	Key        string `yaml:"key" toml:"key"`
+	Value      string `yaml:"value" toml:"value"`
+	Pkg        string `yaml:"pkg" toml:"pkg"`
+	Out        string `yaml:"out" toml:"out"`
+	Ex         bool   `yaml:"ex" toml:"ex"`
+	Shards     int    `yaml:"shards" toml:"shards"`
+	Persistent bool   `yaml:"persistent" toml:"persistent"`
+	Generics   bool   `yaml:"generics" toml:"generics"`
+	DeepEqual  bool   `yaml:"deepequal" toml:"deepequal"`
+}
+
+// loadConfig reads a -config file, choosing the TOML or YAML decoder by
+// file extension (TOML for ".toml", YAML otherwise).
+func loadConfig(path string) (cfg *Config, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg = &Config{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		_, err = toml.Decode(string(b), cfg)
+	} else {
+		err = yaml.Unmarshal(b, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// generatorFactory yields one Generator per -config entry, all sharing a
+// single templateCache so a given template variant is parsed once per run
+// instead of once per entry. goimports and the go/types check still run
+// separately on each entry's rendered output.
+type generatorFactory struct {
+	tmpl *templateCache
+}
+
+// newGeneratorFactory returns a factory ready to build Generators for a
+// batch of -config entries.
+func newGeneratorFactory() *generatorFactory {
+	return &generatorFactory{tmpl: newTemplateCache()}
+}
+
+// New builds a Generator from a single config entry, the config-driven
+// equivalent of NewGenerator parsing CLI flags and the map[T1]T2
+// positional argument, sharing this factory's template cache.
+func (gf *generatorFactory) New(e ConfigEntry) (g *Generator, err error) {
+	defer catch(&err)
+	expect(e.Name != "", "config entry missing name")
+	expect(e.Key != "", "config entry %q missing key", e.Name)
+	expect(e.Value != "", "config entry %q missing value", e.Name)
+	g = &Generator{
+		fset:       gf.tmpl.fset,
+		tmpl:       gf.tmpl,
+		pkg:        e.Pkg,
+		out:        e.Out,
+		name:       e.Name,
+		key:        e.Key,
+		value:      e.Value,
+		ex:         e.Ex,
+		shards:     e.Shards,
+		persistent: e.Persistent,
+		generics:   e.Generics,
+		deepequal:  e.DeepEqual,
+	}
+	if g.pkg == "" {
+		g.pkg = "main"
+	}
+	if g.out == "" {
+		g.out = "001_" + strings.ToLower(g.name) + ".go"
+	}
+	g.funcs = g.Funcs()
+	g.types = g.Types()
+	g.values = g.Values()
+	return
+}
+
+// Generator generates the typed rwmap object.
+type Generator struct {
+	// flag options.
+	pkg        string // package name.
+	out        string // file name.
+	name       string // struct name.
+	key        string // map key type.
+	value      string // map value type.
+	generics   bool   // emit a generic Map[K comparable, V any] instead.
+	shards     int    // shard count, 0 disables striping.
+	persistent bool   // use a persistent treap instead of a plain map.
+	ex         bool   // emit AddStore/AddStores instead of the panic stubs.
+	deepequal  bool   // compare with reflect.DeepEqual instead of == in CompareAndSwap/CompareAndDelete.
+	// mutation state and traversal handlers.
+	file   *ast.File
+	fset   *token.FileSet
+	tmpl   *templateCache
+	funcs  map[string]func(*ast.FuncDecl)
+	types  map[string]func(*ast.TypeSpec)
+	values map[string]func(*ast.ValueSpec)
+}
+
+// templateCache parses each distinct rwmap template variant (the
+// concatenation of templateCode* blocks a given combination of flags
+// selects) exactly once and hands every caller after that a deep copy of
+// its AST, so a batch of Generators built by a generatorFactory pays for
+// parsing once per variant instead of once per entry. Import handling
+// (goimports in render) is not cached and runs for every entry.
+type templateCache struct {
+	fset  *token.FileSet
+	files map[string]*ast.File
+}
+
+// newTemplateCache returns an empty cache backed by a single FileSet, so
+// every clone it hands out shares one set of token.Pos offsets.
+func newTemplateCache() *templateCache {
+	return &templateCache{fset: token.NewFileSet(), files: map[string]*ast.File{}}
+}
+
+// parse returns a fresh deep copy of the AST for src, parsing src only the
+// first time it's requested.
+func (c *templateCache) parse(src string) (*ast.File, error) {
+	f, ok := c.files[src]
+	if !ok {
+		var err error
+		f, err = parser.ParseFile(c.fset, "", src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		c.files[src] = f
+	}
+	return cloneFile(f), nil
+}
+
+// cloneFile returns a deep copy of f, so a cached, already-parsed template
+// can be mutated by a Generator without its renames bleeding into another
+// Generator's copy of the same template.
+func cloneFile(f *ast.File) *ast.File {
+	seen := map[uintptr]reflect.Value{}
+	return deepCopyValue(reflect.ValueOf(f), seen).Interface().(*ast.File)
+}
+
+// deepCopyValue recursively copies v, preserving pointer identity within a
+// single clone via seen so cycles such as an *ast.Ident's Obj pointing back
+// to the *ast.FuncDecl that declares it don't recurse forever.
+func deepCopyValue(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if cp, ok := seen[v.Pointer()]; ok {
+			return cp
+		}
+		cp := reflect.New(v.Type().Elem())
+		seen[v.Pointer()] = cp
+		cp.Elem().Set(deepCopyValue(v.Elem(), seen))
+		return cp
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.New(v.Type()).Elem()
+		cp.Set(deepCopyValue(v.Elem(), seen))
+		return cp
+	case reflect.Struct:
+		cp := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if !cp.Field(i).CanSet() {
+				continue
+			}
+			cp.Field(i).Set(deepCopyValue(v.Field(i), seen))
+		}
+		return cp
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Cap())
+		for i := 0; i < v.Len(); i++ {
+			cp.Index(i).Set(deepCopyValue(v.Index(i), seen))
+		}
+		return cp
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			cp.SetMapIndex(iter.Key(), deepCopyValue(iter.Value(), seen))
+		}
+		return cp
+	default:
+		return v
+	}
+}
+
+// NewGenerator returns a new generator for rwmap.
+func NewGenerator() (g *Generator, err error) {
+	defer catch(&err)
+	tmpl := newTemplateCache()
+	g = &Generator{fset: tmpl.fset, tmpl: tmpl, pkg: *pkg, out: *out, name: *name, generics: *generics, shards: *shards, persistent: *persistent, ex: *ex, deepequal: *deepequal}
+	g.funcs = g.Funcs()
+	g.types = g.Types()
+	g.values = g.Values()
+	exp, err := parser.ParseExpr(os.Args[len(os.Args)-1])
+	check(err, "parse expr: %s", os.Args[len(os.Args)-1])
+	m, ok := exp.(*ast.MapType)
+	expect(ok, "invalid argument. expected map[T1]T2")
+	b := bytes.NewBuffer(nil)
+	err = format.Node(b, g.fset, m.Key)
+	check(err, "format map key")
+	g.key = b.String()
+	b.Reset()
+	err = format.Node(b, g.fset, m.Value)
+	check(err, "format map value")
+	g.value = b.String()
+	if g.out == "" {
+		g.out = "001_" + strings.ToLower(g.name) + ".go"
+	}
+	return
+}
+
+// checkExValueType rejects -ex up front when the value type is obviously
+// incompatible with the `+=` AddStore uses, instead of emitting a template
+// that fails to compile (or worse, panics) downstream.
+func (g *Generator) checkExValueType() error {
+	if !g.ex {
+		return nil
+	}
+	exp, err := parser.ParseExpr(g.value)
+	if err != nil {
+		return nil
+	}
+	switch exp.(type) {
+	case *ast.StructType, *ast.MapType, *ast.ArrayType, *ast.InterfaceType, *ast.ChanType, *ast.FuncType:
+		return fmt.Errorf("AddStore requires an ordered/numeric value type, got %s", g.value)
+	}
+	return nil
+}
+
+// Mutate mutates the original `sync/map` AST and brings it to the desired state.
+// It fails if it encounters an unrecognized node in the AST.
+func (g *Generator) Mutate() (err error) {
+	defer catch(&err)
+	check(g.checkExValueType(), "refusing to generate")
+	modes := 0
+	if g.generics {
+		modes++
+	}
+	if g.shards > 0 {
+		modes++
+	}
+	if g.persistent {
+		modes++
+	}
+	expect(modes <= 1, "-generics, -shards and -persistent are mutually exclusive, pick one")
+	if g.generics {
+		return g.mutateGenerics()
+	}
+	if g.shards > 0 {
+		return g.mutateShard()
+	}
+	if g.persistent {
+		return g.mutatePersistent()
+	}
+	//path := fmt.Sprintf("./rwmap/rwmap/rwmap.go")
+	//b, err := ioutil.ReadFile(path)
+	//check(err, "read %q file", path)
+	tmpl := templateCode
+	if g.deepequal {
+		tmpl += templateCodeCompareDeepEqual
+	} else {
+		tmpl += templateCodeCompareEqual
+	}
+	if g.ex {
+		tmpl += templateCodeExTrue
+	} else {
+		tmpl += templateCodeExFalse
+	}
+	f, err := g.tmpl.parse(tmpl)
+	check(err, "parse base template")
+	f.Name.Name = g.pkg
+	astutil.AddImport(g.fset, f, "sync")
+	if g.deepequal {
+		astutil.AddImport(g.fset, f, "reflect")
+	}
+	dispatch(f, g.funcs, g.types, g.values)
+	rename(f, map[string]string{
+		"Map":      g.name,
+		"entry":    "entry" + strings.Title(g.name),
+		"readOnly": "readOnly" + strings.Title(g.name),
+		"expunged": "expunged" + strings.Title(g.name),
+		"newEntry": "newEntry" + strings.Title(g.name),
+	})
+	g.file = f
+	return
+}
+
+// dispatch walks the top-level declarations of f and routes each one to its
+// matching handler in funcs/types/values, failing if a declaration has no
+// handler or a handler is left unused.
+func dispatch(f *ast.File, funcs map[string]func(*ast.FuncDecl), types map[string]func(*ast.TypeSpec), values map[string]func(*ast.ValueSpec)) {
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			handler, ok := funcs[d.Name.Name]
+			expect(ok, "unrecognized function: %s", d.Name.Name)
+			handler(d)
+			delete(funcs, d.Name.Name)
+		case *ast.GenDecl:
+			switch d := d.Specs[0].(type) {
+			case *ast.TypeSpec:
+				handler, ok := types[d.Name.Name]
+				expect(ok, "unrecognized type: %s", d.Name.Name)
+				handler(d)
+				delete(types, d.Name.Name)
+			case *ast.ValueSpec:
+				handler, ok := values[d.Names[0].Name]
+				expect(ok, "unrecognized value: %s", d.Names[0].Name)
+				handler(d)
+				expect(len(d.Names) == 1, "mismatch values length: %d", len(d.Names))
+				delete(values, d.Names[0].Name)
+			}
+		default:
+			expect(false, "unrecognized type: %s", d)
+		}
+	}
+	expect(len(funcs) == 0, "function was deleted")
+	expect(len(types) == 0, "type was deleted")
+	expect(len(values) == 0, "value was deleted")
+}
+
+// mutateGenerics parses the generic `Map[K comparable, V any]` template and
+// renames it to the requested struct name. Unlike Mutate, it does not
+// substitute `interface{}` occurrences: the type parameters already carry
+// the key/value types, so only the struct/package names need to change.
+func (g *Generator) mutateGenerics() (err error) {
+	defer catch(&err)
+	tmpl := templateCodeGenerics
+	if g.ex {
+		tmpl += templateCodeGenericsExTrue
+	} else {
+		tmpl += templateCodeGenericsExFalse
+	}
+	f, err := g.tmpl.parse(tmpl)
+	check(err, "parse generics template")
+	f.Name.Name = g.pkg
+	astutil.AddImport(g.fset, f, "sync")
+	rename(f, map[string]string{"Map": g.name})
+	f.Decls = append(f.Decls, g.aliasDecl())
+	g.file = f
+	return
+}
+
+// aliasDecl builds the `type <Name><K><V> = <Name>[<key>, <value>]` convenience
+// alias derived from the map[T1]T2 argument, e.g. FooStringInt = Foo[string, int].
+func (g *Generator) aliasDecl() ast.Decl {
+	alias := g.name + exportedTypeName(g.key) + exportedTypeName(g.value)
+	src := fmt.Sprintf("package rwmap\ntype %s = %s[%s, %s]\n", alias, g.name, g.key, g.value)
+	f, err := parser.ParseFile(g.fset, "", src, 0)
+	check(err, "parse alias decl: %s", alias)
+	return f.Decls[0]
+}
+
+// exportedTypeName turns a type expression such as `string`, `int64` or
+// `*pkg.Thing` into an exported identifier fragment suitable for use in an
+// alias name.
+func exportedTypeName(t string) string {
+	t = strings.NewReplacer("*", "Ptr", ".", "_", "[", "_", "]", "_").Replace(t)
+	return strings.Title(t)
+}
+
+// mutateShard parses the shard-striped template and rewrites it with the
+// requested key/value types and shard count.
+func (g *Generator) mutateShard() (err error) {
+	defer catch(&err)
+	tmpl := templateCodeShard
+	if g.deepequal {
+		tmpl += templateCodeShardCompareDeepEqual
+	} else {
+		tmpl += templateCodeShardCompareEqual
+	}
+	if g.ex {
+		tmpl += templateCodeShardExTrue
+	} else {
+		tmpl += templateCodeShardExFalse
+	}
+	f, err := g.tmpl.parse(tmpl)
+	check(err, "parse shard template")
+	f.Name.Name = g.pkg
+	astutil.AddImport(g.fset, f, "sync")
+	if g.deepequal {
+		astutil.AddImport(g.fset, f, "reflect")
+	}
+	dispatch(f, g.ShardFuncs(), g.ShardTypes(), g.ShardValues())
+	rename(f, map[string]string{
+		"Map":        g.name,
+		"shard":      "shard" + strings.Title(g.name),
+		"shardCount": "shardCount" + strings.Title(g.name),
+		"shardIndex": "shardIndex" + strings.Title(g.name),
+	})
+	g.file = f
+	return
+}
+
+// ShardValues returns all ValueSpec handlers for shard-mode AST mutation.
+func (g *Generator) ShardValues() map[string]func(*ast.ValueSpec) {
+	return map[string]func(*ast.ValueSpec){
+		"shardCount": func(v *ast.ValueSpec) {
+			v.Values[0] = expr(fmt.Sprintf("%d", g.shards), v.Values[0].Pos())
+		},
+	}
+}
+
+// ShardTypes returns all TypeSpec handlers for shard-mode AST mutation.
+func (g *Generator) ShardTypes() map[string]func(*ast.TypeSpec) {
+	return map[string]func(*ast.TypeSpec){
+		"shard": func(t *ast.TypeSpec) {
+			l := t.Type.(*ast.StructType).Fields.List[1]
+			g.renameMapType(l)
+		},
+		"Map": func(t *ast.TypeSpec) {},
+	}
+}
+
+// ShardFuncs returns all FuncDecl handlers for shard-mode AST mutation.
+func (g *Generator) ShardFuncs() map[string]func(*ast.FuncDecl) {
+	return map[string]func(*ast.FuncDecl){
+		"checkData": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"shardIndex": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+		},
+		"shardFor": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+		},
+		"Init": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"Change": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Params)
+		},
+		"Load": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
+		},
+		"Store": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
+		"Stores": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Params)
+		},
+		"StoreMap": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Params)
+		},
+		"LoadOrStore": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"LoadAndDelete": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
+		},
+		"Delete": func(f *ast.FuncDecl) { g.replaceKey(f) },
+		"DeleteAll": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"AddStore": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"AddStores": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Params)
+		},
+		"Range": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params.List[0].Type.(*ast.FuncType).Params)
+		},
+		"Items": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Results)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"ItemMap": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Results)
+			g.renameMapType(f.Body)
+			g.renameTuple(f.Body.List[1].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"Len": func(f *ast.FuncDecl) {},
+		"RangeKeys": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"RangeValues": func(f *ast.FuncDecl) {
+			g.replaceValue(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"Swap": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"CompareAndSwap": func(f *ast.FuncDecl) {
+			g.renameCompareSwapTuple(f.Type.Params)
+		},
+		"CompareAndDelete": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
+		"FromDB":      func(f *ast.FuncDecl) {},
+		"ToDB":        func(f *ast.FuncDecl) {},
+		"MarshalJSON": func(f *ast.FuncDecl) {},
+		"UnmarshalJSON": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"String": func(f *ast.FuncDecl) {},
+	}
+}
+
+// mutatePersistent parses the persistent-treap template and rewrites it with
+// the requested key/value types.
+func (g *Generator) mutatePersistent() (err error) {
+	defer catch(&err)
+	tmpl := templateCodePersistent
+	if g.deepequal {
+		tmpl += templateCodePersistentCompareDeepEqual
+	} else {
+		tmpl += templateCodePersistentCompareEqual
+	}
+	if g.ex {
+		tmpl += templateCodePersistentExTrue
+	} else {
+		tmpl += templateCodePersistentExFalse
+	}
+	f, err := g.tmpl.parse(tmpl)
+	check(err, "parse persistent template")
+	f.Name.Name = g.pkg
+	if g.deepequal {
+		astutil.AddImport(g.fset, f, "reflect")
+	}
+	dispatch(f, g.PersistentFuncs(), g.PersistentTypes(), g.PersistentValues())
+	rename(f, map[string]string{
+		"Map":              g.name,
+		"node":             "node" + strings.Title(g.name),
+		"treapInsert":      "treapInsert" + strings.Title(g.name),
+		"treapRotateRight": "treapRotateRight" + strings.Title(g.name),
+		"treapRotateLeft":  "treapRotateLeft" + strings.Title(g.name),
+		"treapDelete":      "treapDelete" + strings.Title(g.name),
+		"treapLoad":        "treapLoad" + strings.Title(g.name),
+		"treapRange":       "treapRange" + strings.Title(g.name),
+	})
+	g.file = f
+	return
+}
+
+// PersistentValues returns all ValueSpec handlers for persistent-mode AST mutation.
+func (g *Generator) PersistentValues() map[string]func(*ast.ValueSpec) {
+	return map[string]func(*ast.ValueSpec){}
+}
+
+// PersistentTypes returns all TypeSpec handlers for persistent-mode AST mutation.
+func (g *Generator) PersistentTypes() map[string]func(*ast.TypeSpec) {
+	return map[string]func(*ast.TypeSpec){
+		"node": func(t *ast.TypeSpec) {
+			fields := t.Type.(*ast.StructType).Fields
+			g.replaceKey(fields.List[0])
+			g.replaceValue(fields.List[1])
+		},
+		"Map": func(t *ast.TypeSpec) {
+			g.replaceKey(t.Type.(*ast.StructType).Fields.List[1])
+		},
+	}
+}
+
+// PersistentFuncs returns all FuncDecl handlers for persistent-mode AST mutation.
+func (g *Generator) PersistentFuncs() map[string]func(*ast.FuncDecl) {
+	less := func(f *ast.FuncDecl) { g.replaceKey(f.Type.Params.List[0]) }
+	return map[string]func(*ast.FuncDecl){
+		"less": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Results)
+			g.replaceKey(f.Body.List[1].(*ast.ReturnStmt).Results[0].(*ast.FuncLit).Type.Params)
+		},
+		"treapInsert": func(f *ast.FuncDecl) {
+			less(f)
+			g.renameTupleAt(f.Type.Params, 2)
+		},
+		"treapRotateRight": func(f *ast.FuncDecl) {},
+		"treapRotateLeft":  func(f *ast.FuncDecl) {},
+		"treapDelete": func(f *ast.FuncDecl) {
+			less(f)
+			g.replaceKey(f.Type.Params.List[2])
+		},
+		"treapLoad": func(f *ast.FuncDecl) {
+			less(f)
+			g.replaceKey(f.Type.Params.List[2])
+			g.replaceValue(f.Type.Results)
+			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
+		},
+		"treapRange": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params.List[1].Type.(*ast.FuncType).Params)
+		},
+		"Init": func(f *ast.FuncDecl) {},
+		"Change": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Params)
+		},
+		"Load": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"Store": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
+		"Stores": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Params)
+		},
+		"StoreMap": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Params)
+		},
+		"LoadOrStore": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"LoadAndDelete": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
+		},
+		"Delete":    func(f *ast.FuncDecl) { g.replaceKey(f) },
+		"DeleteAll": func(f *ast.FuncDecl) {},
+		"Range": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params.List[0].Type.(*ast.FuncType).Params)
+		},
+		"Snapshot": func(f *ast.FuncDecl) {},
+		"Items": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Results)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"ItemMap": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Results)
+			g.renameMapType(f.Body)
+			g.renameTuple(f.Body.List[1].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"Len": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"RangeKeys": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"RangeValues": func(f *ast.FuncDecl) {
+			g.replaceValue(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"Swap": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"CompareAndSwap": func(f *ast.FuncDecl) {
+			g.renameCompareSwapTuple(f.Type.Params)
+		},
+		"CompareAndDelete": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
+		"AddStore": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"AddStores": func(f *ast.FuncDecl) {
+			g.renameTupleList(f.Type.Params)
+		},
+		"FromDB":      func(f *ast.FuncDecl) {},
+		"ToDB":        func(f *ast.FuncDecl) {},
+		"MarshalJSON": func(f *ast.FuncDecl) {},
+		"UnmarshalJSON": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"String": func(f *ast.FuncDecl) {},
+	}
+}
+
+// Gen dumps the mutated AST to a file in the configured destination.
+func (g *Generator) Gen() (err error) {
+	defer catch(&err)
+	src, err := g.render()
+	check(err, "render %s", g.out)
+	err = ioutil.WriteFile(g.out, src, 0644)
+	check(err, "writing file: %s", g.out)
+	return
+}
+
+// Stale renders the mutated AST in memory and reports whether it differs
+// from (or is missing from) the on-disk file at g.out, without writing
+// anything. This is what -check uses to verify a tree doesn't need
+// regeneration, e.g. as a CI gate.
+func (g *Generator) Stale() (stale bool, err error) {
+	defer catch(&err)
+	src, err := g.render()
+	check(err, "render %s", g.out)
+	onDisk, readErr := ioutil.ReadFile(g.out)
+	if readErr != nil {
+		return true, nil
+	}
+	return !bytes.Equal(onDisk, src), nil
+}
+
+// render formats the mutated AST, runs goimports, and type-checks the
+// result, returning the final source bytes without writing them anywhere.
+func (g *Generator) render() ([]byte, error) {
+	b := bytes.NewBuffer([]byte("// Code generated by rwmap; DO NOT EDIT.\n\n"))
+	err := format.Node(b, g.fset, g.file)
+	if err != nil {
+		return nil, fmt.Errorf("format mutated code: %s", err)
+	}
+	src, err := imports.Process(g.out, b.Bytes(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("running goimports on %s: %s", g.out, err)
+	}
+	if err := typeCheck(g.out, src); err != nil {
+		return nil, fmt.Errorf("generated file does not type-check: %s", err)
+	}
+	return src, nil
+}
+
+// typeCheck runs go/types over the generated source before it's written, the
+// same way the standard library's go/types/generate_test.go validates
+// machine-transformed source. It catches mistakes the AST mutation can't,
+// such as an -ex value type that doesn't support +=.
+func typeCheck(name string, src []byte) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return fmt.Errorf("parse generated source: %s", err)
+	}
+	var errs []string
+	conf := types.Config{
+		Importer: importer.Default(),
+		Error: func(e error) {
+			// Unresolvable imports (e.g. a vendored dependency the
+			// checker's build context can't see) are an environment
+			// concern, not a defect in the generated code; only
+			// genuine type errors in the generated declarations
+			// should block writing the file.
+			if strings.Contains(e.Error(), "could not import") {
+				return
+			}
+			errs = append(errs, e.Error())
+		},
+	}
+	conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Values returns all ValueSpec handlers for AST mutation.
+func (g *Generator) Values() map[string]func(*ast.ValueSpec) {
+	return map[string]func(*ast.ValueSpec){}
+}
+
+// Types returns all TypesSpec handlers for AST mutation.
+func (g *Generator) Types() map[string]func(*ast.TypeSpec) {
+	return map[string]func(*ast.TypeSpec){
+		"Map": func(t *ast.TypeSpec) {
+			l := t.Type.(*ast.StructType).Fields.List[0]
+			g.renameMapType(l)
+		},
+	}
+}
+
+// Funcs returns all FuncDecl handlers for AST mutation.
+func (g *Generator) Funcs() map[string]func(*ast.FuncDecl) {
+	//nop := func(*ast.FuncDecl) {}
+	return map[string]func(*ast.FuncDecl){
+		"Init": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"checkData": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Body)
+		},
+		"Change": func(f *ast.FuncDecl) {
+			g.renameMapType(f.Type.Params)
+		},
+		"Load": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+			renameNil(f.Body, f.Type.Results.List[0].Names[0].Name)
+		},
+		"Store": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
 		"AddStore": func(f *ast.FuncDecl) {
 			g.renameTuple(f.Type.Params)
 			g.replaceValue(f.Type.Results)
@@ -513,6 +2557,25 @@ func (g *Generator) Funcs() map[string]func(*ast.FuncDecl) {
 		"DeleteAll": func(f *ast.FuncDecl) {
 			g.renameMapKeysValues(f.Body)
 		},
+		"Len": func(f *ast.FuncDecl) {},
+		"RangeKeys": func(f *ast.FuncDecl) {
+			g.replaceKey(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"RangeValues": func(f *ast.FuncDecl) {
+			g.replaceValue(f.Type.Params)
+			g.renameTuple(f.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr).Args[0].(*ast.FuncLit).Type.Params)
+		},
+		"Swap": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+			g.replaceValue(f.Type.Results)
+		},
+		"CompareAndSwap": func(f *ast.FuncDecl) {
+			g.renameCompareSwapTuple(f.Type.Params)
+		},
+		"CompareAndDelete": func(f *ast.FuncDecl) {
+			g.renameTuple(f.Type.Params)
+		},
 		"FromDB":      func(f *ast.FuncDecl) {},
 		"ToDB":        func(f *ast.FuncDecl) {},
 		"MarshalJSON": func(f *ast.FuncDecl) {},
@@ -529,16 +2592,44 @@ func (g *Generator) replaceKey(n ast.Node) { replaceIface(n, g.key) }
 // replaceValue replaces all `interface{}` occurrences in the given Node with the value node.
 func (g *Generator) replaceValue(n ast.Node) { replaceIface(n, g.value) }
 
-func (g *Generator) renameTuple(l *ast.FieldList) {
+func (g *Generator) renameTuple(l *ast.FieldList) { g.renameTupleAt(l, 0) }
+
+// renameTupleAt splits the `key, value interface{}` field at l.List[idx] into
+// separate key-typed and value-typed fields, inserting the value field right
+// after idx.
+func (g *Generator) renameTupleAt(l *ast.FieldList, idx int) {
 	if g.key == g.value {
-		g.replaceKey(l.List[0])
+		g.replaceKey(l.List[idx])
 		return
 	}
-	l.List = append(l.List, &ast.Field{
-		Names: []*ast.Ident{l.List[0].Names[1]},
-		Type:  l.List[0].Type,
-	})
-	l.List[0].Names = l.List[0].Names[:1]
+	valueField := &ast.Field{
+		Names: []*ast.Ident{l.List[idx].Names[1]},
+		Type:  l.List[idx].Type,
+	}
+	l.List = append(l.List, nil)
+	copy(l.List[idx+2:], l.List[idx+1:])
+	l.List[idx+1] = valueField
+	l.List[idx].Names = l.List[idx].Names[:1]
+	g.replaceKey(l.List[idx])
+	g.replaceValue(l.List[idx+1])
+}
+
+// renameCompareSwapTuple splits the `key, old, new interface{}` field used by
+// CompareAndSwap into a key-typed name and two value-typed names.
+func (g *Generator) renameCompareSwapTuple(l *ast.FieldList) {
+	if g.key == g.value {
+		g.replaceKey(l)
+		return
+	}
+	field := l.List[0]
+	valueField := &ast.Field{
+		Names: field.Names[1:],
+		Type:  field.Type,
+	}
+	l.List = []*ast.Field{
+		{Names: field.Names[:1], Type: field.Type},
+		valueField,
+	}
 	g.replaceKey(l.List[0])
 	g.replaceValue(l.List[1])
 }
@@ -648,6 +2739,8 @@ func setPos(n ast.Node, p token.Pos) {
 	switch n := n.(type) {
 	case *ast.Ident:
 		n.NamePos = p
+	case *ast.BasicLit:
+		n.ValuePos = p
 	case *ast.MapType:
 		n.Map = p
 		setPos(n.Key, p)
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+// TestTwoPersistentMapsSamePackage reproduces two -config entries generating
+// -persistent maps into the same package: the treap helper funcs must be
+// namespaced per g.name the same way node already is, or the second entry's
+// declarations collide with (and type-mismatch against) the first's.
+func TestTwoPersistentMapsSamePackage(t *testing.T) {
+	a := renderEntry(t, "P1", 0, true)
+	b := renderEntry(t, "P2", 0, true)
+	buildPackage(t, map[string][]byte{"p1.go": a, "p2.go": b})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// benchDriverSrc is the Benchmark pair run against the generated map types,
+// the way chunk0-2 asked benchmarks to compare the striped map against the
+// single-lock version under mixed read/write load.
+const benchDriverSrc = `package repro
+
+import "testing"
+
+func benchMixed(b *testing.B, load func(interface{}) (interface{}, bool), store func(interface{}, interface{})) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := i % 1024
+			if i%10 == 0 {
+				store(key, i)
+			} else {
+				load(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSingleLock(b *testing.B) {
+	m := &SingleLockBenchMap{}
+	benchMixed(b, m.Load, func(k, v interface{}) { m.Store(k, v) })
+}
+
+func BenchmarkSharded(b *testing.B) {
+	m := &ShardedBenchMap{}
+	benchMixed(b, m.Load, func(k, v interface{}) { m.Store(k, v) })
+}
+`
+
+// TestShardedVsSingleLockBenchmark generates a single-lock map and a
+// -shards map via the real Generator/render pipeline, drops them into a
+// throwaway module alongside a mixed-read/write Benchmark pair, and runs
+// `go test -bench` against that generated code, so the comparison measures
+// the actual mutation output rather than a hand-rolled lookalike.
+func TestShardedVsSingleLockBenchmark(t *testing.T) {
+	single := renderEntryTyped(t, "SingleLockBenchMap", "interface{}", "interface{}", 0, false)
+	sharded := renderEntryTyped(t, "ShardedBenchMap", "interface{}", "interface{}", 8, false)
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"go.mod":        []byte("module repro\n\ngo 1.21\n"),
+		"single.go":     single,
+		"sharded.go":    sharded,
+		"bench_test.go": []byte(benchDriverSrc),
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "test", "-bench=.", "-run=^$", "-benchtime=20x")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go test -bench failed: %s\n%s", err, out)
+	}
+	t.Logf("generated-code benchmark results:\n%s", out)
+}
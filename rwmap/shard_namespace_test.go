@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// renderEntry drives the Generator/render() pipeline the same way -config
+// does for one entry, returning the generated source for name.
+func renderEntry(t *testing.T, name string, shards int, persistent bool) []byte {
+	t.Helper()
+	return renderEntryTyped(t, name, "string", "int", shards, persistent)
+}
+
+// renderEntryTyped is renderEntry with an explicit key/value type pair.
+func renderEntryTyped(t *testing.T, name, key, value string, shards int, persistent bool) []byte {
+	t.Helper()
+	tmpl := newTemplateCache()
+	g := &Generator{
+		fset:       tmpl.fset,
+		tmpl:       tmpl,
+		pkg:        "repro",
+		out:        name + ".go",
+		name:       name,
+		key:        key,
+		value:      value,
+		shards:     shards,
+		persistent: persistent,
+	}
+	g.funcs = g.Funcs()
+	g.types = g.Types()
+	g.values = g.Values()
+	if err := g.Mutate(); err != nil {
+		t.Fatalf("Mutate %s: %s", name, err)
+	}
+	src, err := g.render()
+	if err != nil {
+		t.Fatalf("render %s: %s", name, err)
+	}
+	return src
+}
+
+// buildPackage writes files into a throwaway module and runs `go build` over
+// all of them together, the way two -config entries sharing one pkg end up
+// compiled together in the real tree.
+func buildPackage(t *testing.T, files map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module repro\n\ngo 1.21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "build", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %s\n%s", err, out)
+	}
+}
+
+// TestTwoShardMapsSamePackage reproduces two -config entries generating
+// -shards maps into the same package: shardCount/shardIndex must be
+// namespaced per g.name the same way shard already is, or the second
+// entry's declarations collide with the first's.
+func TestTwoShardMapsSamePackage(t *testing.T) {
+	a := renderEntry(t, "B1", 4, false)
+	b := renderEntry(t, "B2", 8, false)
+	buildPackage(t, map[string][]byte{"b1.go": a, "b2.go": b})
+}